@@ -16,20 +16,37 @@ package cc
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"log"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/google/blueprint"
+
 	"android/soong/android"
+	"android/soong/cc/config"
 )
 
 // This singleton generates a compile_commands.json file. It does so for each
 // blueprint Android.bp resulting in a cc.Module when either make, mm, mma, mmm
-// or mmma is called. It will only create a single compile_commands.json file
-// at out/development/ide/compdb/compile_commands.json. It will also symlink it
-// to ${SOONG_LINK_COMPDB_TO} if set. In general this should be created by running
-// make SOONG_GEN_COMPDB=1 nothing to get all targets.
+// or mmma is called. The file is written out as a real ninja build action
+// under $OUT_DIR/soong/development/ide/compdb, so it is only regenerated when
+// one of its inputs changes, and it is exposed as a "compdb" phony target.
+// That target is not part of the default build, so the file is only built
+// when `SOONG_GEN_COMPDB=1 m compdb` (or another goal depending on it) is
+// run. It will also symlink it to ${SOONG_LINK_COMPDB_TO} if set.
+//
+// Besides each module's sources, it also adds an entry for every .h, .hpp,
+// and .inc file under a module's own -I include dirs (those inside the
+// module's directory), reusing a representative translation unit's flags, so
+// headers resolve correctly in an editor. As a last resort for files not
+// covered by any entry, it also writes a sibling compile_flags.txt (the union
+// of -I/-isystem/-D/--target= flags across the whole tree) and a minimal
+// .clangd pointing at the generated database.
+//
+// In general this should be created by running SOONG_GEN_COMPDB=1 m compdb
+// to get all targets.
 
 func init() {
 	android.RegisterSingletonType("compdb_generator", compDBGeneratorSingleton)
@@ -43,18 +60,31 @@ type compdbGeneratorSingleton struct{}
 
 const (
 	compdbFilename                = "compile_commands.json"
-	compdbOutputProjectsDirectory = "out/development/ide/compdb"
+	compileFlagsFilename          = "compile_flags.txt"
+	clangdConfigFilename          = ".clangd"
+	compdbOutputProjectsDirectory = "development/ide/compdb"
 
 	// Environment variables used to modify behavior of this singleton.
 	envVariableGenerateCompdb          = "SOONG_GEN_COMPDB"
 	envVariableGenerateCompdbDebugInfo = "SOONG_GEN_COMPDB_DEBUG"
 	envVariableCompdbLink              = "SOONG_LINK_COMPDB_TO"
+	// SOONG_COMPDB_FILTER restricts which module variants get an entry, as a
+	// comma-separated list of key=value pairs, e.g. "arch=arm64,variant=vendor".
+	// It is read from the environment only; Soong config variables are not
+	// consulted.
+	envVariableCompdbFilter = "SOONG_COMPDB_FILTER"
+	// SOONG_COMPDB_COMMAND_FIELD switches entries from the "arguments" array
+	// form to the single shell-escaped "command" string form, for tools that
+	// don't support "arguments".
+	envVariableCompdbCommandField = "SOONG_COMPDB_COMMAND_FIELD"
 )
 
-// A compdb entry. The compile_commands.json file is a list of these.
+// A compdb entry. The compile_commands.json file is a list of these. Exactly
+// one of Arguments or Command is set, depending on SOONG_COMPDB_COMMAND_FIELD.
 type compDbEntry struct {
 	Directory string   `json:"directory"`
-	Arguments []string `json:"arguments"`
+	Arguments []string `json:"arguments,omitempty"`
+	Command   string   `json:"command,omitempty"`
 	File      string   `json:"file"`
 	Output    string   `json:"output,omitempty"`
 }
@@ -67,49 +97,118 @@ func (c *compdbGeneratorSingleton) GenerateBuildActions(ctx android.SingletonCon
 	// Instruct the generator to indent the json file for easier debugging.
 	outputCompdbDebugInfo := ctx.Config().IsEnvTrue(envVariableGenerateCompdbDebugInfo)
 
-	// We only want one entry per file. We don't care what module/isa it's from
+	// Without a filter, only each module's PrimaryModule() variant gets an
+	// entry, since most consumers (clangd, ycm) only want a single entry per
+	// source file. SOONG_COMPDB_FILTER opts into every matching variant
+	// instead, for cases where a source is compiled several different ways
+	// and a single set of flags isn't good enough.
+	filter := parseCompdbFilter(ctx.Config().Getenv(envVariableCompdbFilter))
+	useCommandField := ctx.Config().IsEnvTrue(envVariableCompdbCommandField)
+
+	// The map is keyed by the per-variant object file path rather than by
+	// source path, so a file compiled for several arches, bitnesses, sdk
+	// variants, or with/without sanitizers gets one compdb entry per variant
+	// instead of collapsing to whichever variant GenerateBuildActions
+	// happened to visit first.
 	m := make(map[string]compDbEntry)
+	// Headers don't have an output of their own, so they're kept in a
+	// separate map keyed by header path; the first module to claim a given
+	// header wins.
+	headers := make(map[string]compDbEntry)
+	// Union of the -I/-isystem/-D/--target= flags seen across every entry,
+	// for the compile_flags.txt fallback.
+	flagSet := make(map[string]bool)
 	ctx.VisitAllModules(func(module android.Module) {
-		if ccModule, ok := module.(*Module); ok {
-			if compiledModule, ok := ccModule.compiler.(CompiledInterface); ok {
-				generateCompdbProject(compiledModule, ctx, ccModule, m)
+		ccModule, ok := module.(*Module)
+		if !ok {
+			return
+		}
+		compiledModule, ok := ccModule.compiler.(CompiledInterface)
+		if !ok {
+			return
+		}
+		if len(filter) == 0 {
+			if ctx.PrimaryModule(ccModule) != ccModule {
+				return
 			}
+		} else if !compdbFilterMatches(ctx, ccModule, filter) {
+			return
 		}
+		generateCompdbProject(compiledModule, ctx, ccModule, m, headers, flagSet, useCommandField)
 	})
 
-	// Create the output file.
-	dir := filepath.Join(getCompdbAndroidSrcRootDirectory(ctx), compdbOutputProjectsDirectory)
-	os.MkdirAll(dir, 0777)
-	compDBFile := filepath.Join(dir, compdbFilename)
-	f, err := os.Create(compdbFilename)
-	if err != nil {
-		log.Fatalf("Could not create file %s: %s", filepath.Join(dir, compdbFilename), err)
-	}
-	defer f.Close()
-
-	v := make([]compDbEntry, 0, len(m))
-
+	v := make([]compDbEntry, 0, len(m)+len(headers))
 	for _, value := range m {
 		v = append(v, value)
 	}
+	for _, value := range headers {
+		v = append(v, value)
+	}
+
 	var dat []byte
+	var err error
 	if outputCompdbDebugInfo {
 		dat, err = json.MarshalIndent(v, "", " ")
 	} else {
 		dat, err = json.Marshal(v)
 	}
 	if err != nil {
-		log.Fatalf("Failed to marshal: %s", err)
+		ctx.Errorf("failed to marshal compile_commands.json: %s", err)
+		return
+	}
+
+	// The entries are fully known at analysis time, so stage them as a
+	// ninja-tracked fragment instead of writing compile_commands.json
+	// directly from Go. A small host tool then turns the fragment(s) into
+	// the final file (and, optionally, the SOONG_LINK_COMPDB_TO symlink) as
+	// a real build action, so this all keeps working under the sandboxed
+	// soong_build, which chdirs to "/" before GenerateBuildActions runs.
+	// compdb_merge re-encodes the entries compactly, so the indentation
+	// added for SOONG_GEN_COMPDB_DEBUG is only kept in the fragment, not in
+	// the final compile_commands.json.
+	fragment := android.PathForOutput(ctx, compdbOutputProjectsDirectory, compdbFilename+".fragment")
+	android.WriteFileRule(ctx, fragment, string(dat))
+
+	outputFile := android.PathForOutput(ctx, compdbOutputProjectsDirectory, compdbFilename)
+
+	rule := android.NewRuleBuilder(pctx, ctx)
+	cmd := rule.Command().
+		BuiltTool("compdb_merge").
+		FlagWithInput("-i ", fragment).
+		FlagWithOutput("-o ", outputFile)
+	if link := ctx.Config().Getenv(envVariableCompdbLink); link != "" {
+		// SOONG_LINK_COMPDB_TO names a directory to link compile_commands.json
+		// into, not the link path itself.
+		cmd.FlagWithArg("-symlink ", filepath.Join(link, compdbFilename))
 	}
-	f.Write(dat)
+	rule.Build("compdb", "generate "+compdbFilename)
 
-	finalLinkPath := filepath.Join(ctx.Config().Getenv(envVariableCompdbLink), compdbFilename)
-	if finalLinkPath != "" {
-		os.Remove(finalLinkPath)
-		if err := os.Symlink(compDBFile, finalLinkPath); err != nil {
-			log.Fatalf("Unable to symlink %s to %s: %s", compDBFile, finalLinkPath, err)
+	phonyInputs := []android.Path{outputFile}
+
+	// compile_flags.txt and .clangd are a last-resort fallback for files
+	// that aren't covered by any compdb entry at all (e.g. a header that
+	// isn't under any module's own include dirs).
+	if len(flagSet) > 0 {
+		flags := make([]string, 0, len(flagSet))
+		for flag := range flagSet {
+			flags = append(flags, flag)
 		}
+		sort.Strings(flags)
+
+		compileFlagsFile := android.PathForOutput(ctx, compdbOutputProjectsDirectory, compileFlagsFilename)
+		android.WriteFileRule(ctx, compileFlagsFile, strings.Join(flags, "\n")+"\n")
+		phonyInputs = append(phonyInputs, compileFlagsFile)
+
+		clangdFile := android.PathForOutput(ctx, compdbOutputProjectsDirectory, clangdConfigFilename)
+		android.WriteFileRule(ctx, clangdFile, "CompileFlags:\n  CompilationDatabase: .\n")
+		phonyInputs = append(phonyInputs, clangdFile)
 	}
+
+	ctx.Build(pctx, android.BuildParams{
+		Rule:   blueprint.Phony,
+		Output: android.PathForPhony(ctx, "compdb"),
+		Inputs: phonyInputs,
+	})
 }
 
 func expandAllVars(ctx android.SingletonContext, args []string) []string {
@@ -126,28 +225,59 @@ func expandAllVars(ctx android.SingletonContext, args []string) []string {
 	return out
 }
 
-func getArguments(src android.Path, ctx android.SingletonContext, ccModule *Module) []string {
-	var args []string
-	isCpp := false
-	isAsm := false
+// sourceLanguage classifies src by its file extension, so the compdb entry
+// picks the matching clang driver and flag set. Unknown extensions are
+// logged and treated as assembly.
+func sourceLanguage(src android.Path) (isCpp, isAsm bool) {
 	// TODO It would be better to ask soong for the types here.
 	switch src.Ext() {
 	case ".S", ".s", ".asm":
-		isAsm = true
-		isCpp = false
+		return false, true
 	case ".c":
-		isAsm = false
-		isCpp = false
+		return false, false
 	case ".cpp", ".cc", ".mm":
-		isAsm = false
-		isCpp = true
+		return true, false
 	default:
 		log.Print("Unknown file extension " + src.Ext() + " on file " + src.String())
-		isAsm = true
-		isCpp = false
+		return false, true
 	}
-	// The executable for the compilation doesn't matter but we need something there.
-	args = append(args, "/bin/false")
+}
+
+// getArguments builds the clang invocation for src. It returns ok == false
+// if ccModule's toolchain hasn't been resolved for this variant (shouldn't
+// happen for a module with compiled sources, but a singleton has no
+// BaseModuleContext to resolve it itself, so this has to be defensive
+// rather than calling ccModule.toolchain(ctx)).
+func getArguments(src android.Path, ctx android.SingletonContext, ccModule *Module) (args []string, ok bool) {
+	isCpp, isAsm := sourceLanguage(src)
+
+	// (*Module).toolchain takes a BaseModuleContext, which a SingletonContext
+	// doesn't satisfy (it calls ctx.Os()/ctx.Arch()). The module's own
+	// GenerateAndroidBuildActions already resolved and cached its toolchain
+	// by the time singletons run, so read that cache directly instead.
+	toolchain := ccModule.cachedToolchain
+	if toolchain == nil {
+		return nil, false
+	}
+
+	// clangd and ycmd both feed argv[0] to libclang's driver to pick language
+	// mode, target, builtin include paths, and resource-dir, so this needs
+	// to be a real clang/clang++, not a placeholder. --driver-mode= is added
+	// on top in case a tool strips or rewrites argv[0] before handing it to
+	// the driver.
+	clangExe := "clang"
+	driverMode := "gcc"
+	if isCpp {
+		clangExe = "clang++"
+		driverMode = "g++"
+	}
+
+	args = append(args, config.ClangPath(ctx, filepath.Join("bin", clangExe)).String())
+	args = append(args, "--driver-mode="+driverMode)
+	args = append(args, "--target="+toolchain.ClangTriple())
+	// Unlike ClangTriple(), the sysroot isn't exposed on config.Toolchain; it's
+	// baked into GlobalFlags by the same toolchain/NDK plumbing the real
+	// compile rules use, so it comes along for free below.
 	args = append(args, expandAllVars(ctx, ccModule.flags.GlobalFlags)...)
 	args = append(args, expandAllVars(ctx, ccModule.flags.CFlags)...)
 	if isCpp {
@@ -157,27 +287,246 @@ func getArguments(src android.Path, ctx android.SingletonContext, ccModule *Modu
 	}
 	args = append(args, expandAllVars(ctx, ccModule.flags.SystemIncludeFlags)...)
 	args = append(args, src.String())
-	return args
+
+	// clangd's own argument parser doesn't follow @file response files, so
+	// inline anything the real build would have passed that way.
+	return expandResponseFileArgs(ctx, args), true
+}
+
+// expandResponseFileArgs replaces any "@file" argument with the whitespace
+// separated contents of file, read inline. Response files are written under
+// $OUT_DIR, so file is resolved against the output directory rather than
+// the process's cwd, since soong_build chdirs to "/" before
+// GenerateBuildActions runs. Args that aren't response files, or whose file
+// can't be read, are passed through unchanged.
+func expandResponseFileArgs(ctx android.SingletonContext, args []string) []string {
+	var out []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			out = append(out, arg)
+			continue
+		}
+		contents, err := ioutil.ReadFile(android.AbsolutePath(ctx, android.PathForOutput(ctx, arg[1:]).String()))
+		if err != nil {
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, strings.Fields(string(contents))...)
+	}
+	return out
+}
+
+// shellEscapeArgs joins args into a single shell command line, quoting any
+// argument that contains characters a shell would otherwise treat specially.
+func shellEscapeArgs(args []string) string {
+	escaped := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]{}#~!") {
+			escaped = append(escaped, arg)
+			continue
+		}
+		escaped = append(escaped, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(escaped, " ")
 }
 
-func generateCompdbProject(compiledModule CompiledInterface, ctx android.SingletonContext, ccModule *Module, builds map[string]compDbEntry) {
+func generateCompdbProject(compiledModule CompiledInterface, ctx android.SingletonContext, ccModule *Module, builds map[string]compDbEntry, headers map[string]compDbEntry, flagSet map[string]bool, useCommandField bool) {
 	srcs := compiledModule.Srcs()
 	if len(srcs) == 0 {
 		return
 	}
 
 	rootDir := getCompdbAndroidSrcRootDirectory(ctx)
+
+	// A representative translation unit for this module, reused to give
+	// headers under this module's include dirs a set of flags. C++ is
+	// preferred over C, since C++ flags are a superset clang will accept for
+	// both language modes.
+	var representativeArgs []string
+
 	for _, src := range srcs {
-		if _, ok := builds[src.String()]; !ok {
-			builds[src.String()] = compDbEntry{
-				Directory: rootDir,
-				Arguments: getArguments(src, ctx, ccModule),
-				File:      src.String(),
+		args, ok := getArguments(src, ctx, ccModule)
+		if !ok {
+			continue
+		}
+		collectFallbackFlags(args, flagSet)
+
+		if representativeArgs == nil || isCppSource(src) {
+			representativeArgs = args
+		}
+
+		output := objectFileForSource(ctx, ccModule, src)
+		if _, ok := builds[output]; ok {
+			continue
+		}
+
+		entry := compDbEntry{
+			Directory: rootDir,
+			File:      src.String(),
+			Output:    output,
+		}
+		if useCommandField {
+			entry.Command = shellEscapeArgs(args)
+		} else {
+			entry.Arguments = args
+		}
+		builds[output] = entry
+	}
+
+	generateCompdbHeaders(ctx, rootDir, ccModule, representativeArgs, headers, useCommandField)
+}
+
+func isCppSource(src android.Path) bool {
+	isCpp, _ := sourceLanguage(src)
+	return isCpp
+}
+
+// generateCompdbHeaders walks ccModule's own local/exported include dirs
+// (the "-I" flags Soong emits for Local_include_dirs/Export_include_dirs
+// and HeaderLibs, rooted under the module's own source directory, as
+// opposed to "-isystem", which is reserved for system, NDK, and prebuilt
+// header roots) and adds a compdb entry for every header under them,
+// reusing representativeArgs' flags with the header substituted in for the
+// representative TU's own source file. The first module to claim a given
+// header wins.
+func generateCompdbHeaders(ctx android.SingletonContext, rootDir string, ccModule *Module, representativeArgs []string, headers map[string]compDbEntry, useCommandField bool) {
+	if len(representativeArgs) == 0 {
+		return
+	}
+	moduleDir := ctx.ModuleDir(ccModule)
+	// The last argument is the representative TU's own source path; each
+	// header entry needs its own file in that slot instead.
+	flagArgs := representativeArgs[:len(representativeArgs)-1]
+
+	seenDirs := make(map[string]bool)
+	for _, dir := range moduleOwnedIncludeDirs(moduleDir, representativeArgs) {
+		if dir == "" || seenDirs[dir] {
+			continue
+		}
+		seenDirs[dir] = true
+
+		for _, ext := range []string{"h", "hpp", "inc"} {
+			matches, err := ctx.GlobWithDeps(filepath.Join(dir, "**/*."+ext), nil)
+			if err != nil {
+				continue
+			}
+			for _, header := range matches {
+				if _, ok := headers[header]; ok {
+					continue
+				}
+				headerArgs := append(append([]string{}, flagArgs...), header)
+				entry := compDbEntry{
+					Directory: rootDir,
+					File:      header,
+				}
+				if useCommandField {
+					entry.Command = shellEscapeArgs(headerArgs)
+				} else {
+					entry.Arguments = headerArgs
+				}
+				headers[header] = entry
 			}
 		}
 	}
 }
 
+// moduleOwnedIncludeDirs returns the "-I" (local/exported, not system)
+// include dirs from args that live under moduleDir, i.e. the directories a
+// module's own Local_include_dirs, Export_include_dirs, and HeaderLibs
+// plumbing contributes for itself, rather than every -I/-isystem root
+// pulled in transitively from system, NDK, or third-party dependencies.
+func moduleOwnedIncludeDirs(moduleDir string, args []string) []string {
+	var dirs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var dir string
+		switch {
+		case arg == "-I":
+			if i+1 >= len(args) {
+				continue
+			}
+			dir = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-I"):
+			dir = arg[len("-I"):]
+		default:
+			continue
+		}
+		if dir != "" && (dir == moduleDir || strings.HasPrefix(dir, moduleDir+"/")) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// collectFallbackFlags records the -I, -isystem, -D, and --target= flags
+// from args into flagSet, for the compile_flags.txt fallback. Each flag is
+// normalized to its attached single-token form (e.g. "-Idir", "-isystemdir")
+// since flagSet entries are later sorted independently, and clang accepts
+// -I/-isystem/-D either attached or as two separate argv entries.
+func collectFallbackFlags(args []string, flagSet map[string]bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-I" || arg == "-isystem" || arg == "-D":
+			if i+1 < len(args) {
+				flagSet[arg+args[i+1]] = true
+				i++
+			}
+		case strings.HasPrefix(arg, "-I"), strings.HasPrefix(arg, "-D"), strings.HasPrefix(arg, "-isystem"), strings.HasPrefix(arg, "--target="):
+			flagSet[arg] = true
+		}
+	}
+}
+
+// objectFileForSource returns the path of the object file a given (module
+// variant, source) pair compiles to, under the module's intermediates
+// directory (.intermediates/<module dir>/<name>/<variant>/obj/). It's used
+// as the compdb map key so that the same source compiled several different
+// ways gets one entry per variant rather than one entry overall. ModuleSubDir
+// alone only names the variant (e.g. "android_arm64_armv8-a_shared"), not
+// the module, so two modules with a same-named source in the same variant
+// would otherwise collide; include the module's directory and name too, the
+// same way its real intermediates path is built.
+func objectFileForSource(ctx android.SingletonContext, ccModule *Module, src android.Path) string {
+	rel := src.Rel()
+	rel = strings.TrimSuffix(rel, filepath.Ext(rel)) + ".o"
+	return android.PathForOutput(ctx, ".intermediates", ctx.ModuleDir(ccModule), ccModule.Name(),
+		ctx.ModuleSubDir(ccModule), "obj", rel).String()
+}
+
+// parseCompdbFilter parses a SOONG_COMPDB_FILTER value like
+// "arch=arm64,variant=vendor" into a key/value map.
+func parseCompdbFilter(filter string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(filter, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result
+}
+
+// compdbFilterMatches reports whether ccModule's variant matches every
+// key=value pair in filter. Recognized keys are "arch", matched against the
+// variant's ArchType, and "variant", matched as a substring of the variant's
+// subdirectory name (which encodes things like os, sdk version, and whether
+// sanitizers are enabled).
+func compdbFilterMatches(ctx android.SingletonContext, ccModule *Module, filter map[string]string) bool {
+	if arch, ok := filter["arch"]; ok && ccModule.Target().Arch.ArchType.String() != arch {
+		return false
+	}
+	if variant, ok := filter["variant"]; ok && !strings.Contains(ctx.ModuleSubDir(ccModule), variant) {
+		return false
+	}
+	return true
+}
+
 func evalAndSplitVariable(ctx android.SingletonContext, str string) ([]string, error) {
 	evaluated, err := ctx.Eval(pctx, str)
 	if err == nil {
@@ -187,6 +536,5 @@ func evalAndSplitVariable(ctx android.SingletonContext, str string) ([]string, e
 }
 
 func getCompdbAndroidSrcRootDirectory(ctx android.SingletonContext) string {
-	srcPath, _ := filepath.Abs(android.PathForSource(ctx).String())
-	return srcPath
+	return android.AbsolutePath(ctx, android.PathForSource(ctx).String())
 }
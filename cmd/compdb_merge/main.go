@@ -0,0 +1,100 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// compdb_merge concatenates one or more compile_commands.json fragments
+// (each a JSON array of entries) into a single compile_commands.json file,
+// and optionally symlinks the result to another path. The output is written
+// compactly; any indentation in the fragments is not kept.
+//
+// It is invoked from a ninja build action registered by the cc package's
+// compdb_generator singleton, so that compile_commands.json participates in
+// soong's incremental build graph instead of being written directly from Go
+// during analysis.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type stringList []string
+
+func (l *stringList) String() string { return fmt.Sprint([]string(*l)) }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	inputs  stringList
+	output  = flag.String("o", "", "output compile_commands.json path")
+	symlink = flag.String("symlink", "", "if set, symlink the output file to this path")
+)
+
+func init() {
+	flag.Var(&inputs, "i", "input fragment file, may be repeated")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "compdb_merge: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+
+	if *output == "" {
+		fatalf("-o is required")
+	}
+	if len(inputs) == 0 {
+		fatalf("at least one -i is required")
+	}
+
+	var merged []json.RawMessage
+	for _, in := range inputs {
+		data, err := ioutil.ReadFile(in)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		var fragment []json.RawMessage
+		if err := json.Unmarshal(data, &fragment); err != nil {
+			fatalf("%s: %s", in, err)
+		}
+		merged = append(merged, fragment...)
+	}
+
+	out, err := json.Marshal(merged)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if err := ioutil.WriteFile(*output, out, 0666); err != nil {
+		fatalf("%s", err)
+	}
+
+	if *symlink != "" {
+		abs, err := filepath.Abs(*output)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		os.Remove(*symlink)
+		if err := os.Symlink(abs, *symlink); err != nil {
+			fatalf("%s", err)
+		}
+	}
+}